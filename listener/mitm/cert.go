@@ -0,0 +1,305 @@
+package mitm
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLeafCacheSize     = 1024
+	defaultLeafCacheTTL      = 2 * time.Hour
+	defaultUpstreamCacheSize = 256
+	defaultUpstreamCacheTTL  = 10 * time.Minute
+	defaultLeafValidity      = 7 * 24 * time.Hour
+)
+
+// sctListOID is the X.509v3 extension OID for the SCT list
+// (RFC 6962, embedded in cert). Copied verbatim from a mirrored upstream
+// leaf, when present, so clients that check for it don't choke on its
+// absence.
+var sctListOID = []int{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// CertConfig forges per-host leaf certificates signed by a single
+// configured CA, caching them by SNI so repeated connections to the same
+// host don't pay certificate generation cost on every CONNECT.
+type CertConfig struct {
+	ca    *x509.Certificate
+	caKey crypto.Signer
+
+	leaves            *lruCache
+	upstreamTemplates *lruCache
+
+	mirrorUpstream bool
+	dialTimeout    time.Duration
+}
+
+// CertConfigOption configures a CertConfig built by NewCertConfig.
+type CertConfigOption func(*CertConfig)
+
+// WithCacheSize overrides how many leaf certificates are kept cached.
+func WithCacheSize(n int) CertConfigOption {
+	return func(c *CertConfig) { c.leaves.size = n }
+}
+
+// WithCacheTTL overrides how long a cached leaf certificate stays valid.
+func WithCacheTTL(ttl time.Duration) CertConfigOption {
+	return func(c *CertConfig) { c.leaves.ttl = ttl }
+}
+
+// WithUpstreamMirroring makes the forged leaf copy CN/SANs/validity/key
+// usage from the real origin certificate, for better compatibility with
+// apps that pin on subject fields instead of the public key.
+func WithUpstreamMirroring(enabled bool) CertConfigOption {
+	return func(c *CertConfig) { c.mirrorUpstream = enabled }
+}
+
+// NewCertConfig creates a CertConfig that signs leaves with ca/caKey.
+func NewCertConfig(ca *x509.Certificate, caKey crypto.Signer, opts ...CertConfigOption) *CertConfig {
+	c := &CertConfig{
+		ca:                ca,
+		caKey:             caKey,
+		leaves:            newLRUCache(defaultLeafCacheSize, defaultLeafCacheTTL),
+		upstreamTemplates: newLRUCache(defaultUpstreamCacheSize, defaultUpstreamCacheTTL),
+		dialTimeout:       5 * time.Second,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// GetCA returns the CA certificate clients should trust (served at
+// /cert.crt).
+func (c *CertConfig) GetCA() *x509.Certificate {
+	return c.ca
+}
+
+// NewTLSConfigForHost returns a tls.Config that forges a leaf certificate
+// for whatever SNI the connecting client actually presents, falling back to
+// fallbackHost (the CONNECT target) only when the ClientHello carries no
+// server name at all.
+func (c *CertConfig) NewTLSConfigForHost(fallbackHost string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			sni := hello.ServerName
+			if sni == "" {
+				if host, _, err := net.SplitHostPort(fallbackHost); err == nil {
+					sni = host
+				} else {
+					sni = fallbackHost
+				}
+			}
+
+			return c.certForSNI(sni)
+		},
+	}
+}
+
+func (c *CertConfig) certForSNI(sni string) (*tls.Certificate, error) {
+	if cached, ok := c.leaves.Get(sni); ok {
+		return cached.(*tls.Certificate), nil
+	}
+
+	var template *x509.Certificate
+	if c.mirrorUpstream {
+		template, _ = c.fetchUpstreamTemplate(sni)
+	}
+
+	leaf, err := c.issueLeaf(sni, template)
+	if err != nil {
+		return nil, err
+	}
+
+	c.leaves.Put(sni, leaf)
+
+	return leaf, nil
+}
+
+// fetchUpstreamTemplate dials the real sni:443 and returns its leaf
+// certificate to use as a template, caching it separately (and for less
+// long) from the forged leaves themselves.
+func (c *CertConfig) fetchUpstreamTemplate(sni string) (*x509.Certificate, error) {
+	if cached, ok := c.upstreamTemplates.Get(sni); ok {
+		return cached.(*x509.Certificate), nil
+	}
+
+	dialer := &net.Dialer{Timeout: c.dialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(sni, "443"), &tls.Config{
+		ServerName:         sni,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	peers := conn.ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		return nil, errors.New("mitm: upstream presented no certificate")
+	}
+
+	c.upstreamTemplates.Put(sni, peers[0])
+
+	return peers[0], nil
+}
+
+// issueLeaf forges a leaf certificate for sni, signed by the configured CA.
+// When template is non-nil (upstream mirroring), CN/SANs/validity/key usage
+// are copied from it; otherwise sane defaults are used.
+func (c *CertConfig) issueLeaf(sni string, template *x509.Certificate) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	leaf := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: sni},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(defaultLeafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if ip := net.ParseIP(sni); ip != nil {
+		leaf.IPAddresses = []net.IP{ip}
+	} else {
+		leaf.DNSNames = []string{sni}
+	}
+
+	if template != nil {
+		leaf.Subject = template.Subject
+		leaf.DNSNames = template.DNSNames
+		leaf.IPAddresses = template.IPAddresses
+		leaf.NotBefore = template.NotBefore
+		leaf.NotAfter = template.NotAfter
+		leaf.KeyUsage = template.KeyUsage
+		leaf.ExtKeyUsage = template.ExtKeyUsage
+
+		if sct := findExtension(template, sctListOID); sct != nil {
+			leaf.ExtraExtensions = append(leaf.ExtraExtensions, *sct)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, leaf, c.ca, key.Public(), c.caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, c.ca.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func findExtension(cert *x509.Certificate, oid []int) *pkix.Extension {
+	for _, ext := range cert.Extensions {
+		if oidEqual(ext.Id, oid) {
+			return &ext
+		}
+	}
+
+	return nil
+}
+
+func oidEqual(id []int, oid []int) bool {
+	if len(id) != len(oid) {
+		return false
+	}
+	for i := range id {
+		if id[i] != oid[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lruCache is a small, size- and TTL-bounded cache shared by the leaf and
+// upstream-template caches.
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := el.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+
+	return entry.value, true
+}
+
+func (c *lruCache) Put(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = time.Now().Add(c.ttl)
+		c.order.MoveToFront(el)
+		return
+	}
+
+	el := c.order.PushFront(&lruEntry{key: key, value: value, expires: time.Now().Add(c.ttl)})
+	c.items[key] = el
+
+	if c.size > 0 && c.order.Len() > c.size {
+		back := c.order.Back()
+		if back != nil {
+			c.order.Remove(back)
+			delete(c.items, back.Value.(*lruEntry).key)
+		}
+	}
+}
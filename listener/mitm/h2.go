@@ -0,0 +1,109 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+
+	C "github.com/Dreamacro/clash/constant"
+	httpL "github.com/Dreamacro/clash/listener/http"
+)
+
+// serveH2 takes over a hijacked, already-handshaken TLS connection that
+// negotiated ALPN "h2" and serves it as HTTP/2, forwarding every request to
+// its real origin over an http2.Transport. It blocks until the connection is
+// closed.
+//
+// All requests multiplexed over this one connection share a single
+// http.Client (built lazily from the first request, since none is available
+// yet when the connection is taken over), so they reuse the same
+// http2.Transport and its underlying connection pool instead of each
+// dialing a fresh one.
+func serveH2(tlsConn *tls.Conn, opt *Option, in chan<- C.ConnContext, source net.Addr) {
+	var (
+		once   sync.Once
+		client *http.Client
+	)
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			once.Do(func() {
+				client = newClient(source, r.Header.Get("User-Agent"), in)
+				if transport, ok := client.Transport.(*http.Transport); ok {
+					// Upgrade the existing transport in place so the
+					// proxy-chain dialer newClient wired up (routed through
+					// the in channel) is preserved; replacing it outright
+					// would make h2 origins bypass proxy routing.
+					_ = http2.ConfigureTransport(transport)
+				}
+			})
+
+			serveH2Request(w, r, opt, client)
+		}),
+	}
+
+	h2s := &http2.Server{}
+	h2s.ServeConn(tlsConn, &http2.ServeConnOpts{BaseConfig: server})
+
+	if client != nil {
+		client.CloseIdleConnections()
+	}
+}
+
+func serveH2Request(w http.ResponseWriter, r *http.Request, opt *Option, client *http.Client) {
+	r.URL.Scheme = "https"
+	if r.URL.Host == "" {
+		r.URL.Host = r.Host
+	}
+
+	session := NewSession(nil, r, nil)
+
+	if opt.Handler != nil {
+		newReq, newRes := opt.Handler.HandleRequest(session)
+		if newReq != nil {
+			r = newReq
+		}
+		if newRes != nil {
+			writeH2Response(w, newRes)
+			return
+		}
+	}
+
+	httpL.RemoveHopByHopHeaders(r.Header)
+	r.RequestURI = ""
+
+	res, err := client.Do(r)
+	if err != nil {
+		handleError(opt, session, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	session.response = res
+	if opt.Handler != nil {
+		if rewritten := opt.Handler.HandleResponse(session); rewritten != nil {
+			res = rewritten
+		}
+	}
+
+	writeH2Response(w, res)
+}
+
+func writeH2Response(w http.ResponseWriter, res *http.Response) {
+	defer func() { _ = res.Body.Close() }()
+
+	httpL.RemoveHopByHopHeaders(res.Header)
+
+	for k, values := range res.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
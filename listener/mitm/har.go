@@ -0,0 +1,101 @@
+package mitm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"github.com/Dreamacro/clash/listener/mitm/har"
+)
+
+// beginResponseCapture marks the moment response headers became available
+// and arranges for capture to tee the response body as it's streamed to the
+// client, rather than buffering a snapshot upfront — buffering ahead would
+// hold back delivery of a long-lived response (e.g. SSE) until the snapshot
+// filled or the stream ended. Call this before the response is written to
+// the client; call recordHAR after, once it's been fully written.
+func beginResponseCapture(capture *har.Capture, session *Session) {
+	if session.response != nil {
+		capture.Respond(session.response)
+	}
+}
+
+// recordHAR finishes the in-flight har.Capture, now that the response has
+// been fully streamed to the client, and files the resulting entry into
+// opt.HARRecorder. c is the client-facing connection (used only for TLS
+// info); the upstream ServerIPAddress comes from capture.Trace, and source
+// is the intercepted client's own address.
+func recordHAR(opt *Option, capture *har.Capture, session *Session, c net.Conn, source net.Addr) {
+	var clientIP string
+	if source != nil {
+		if host, _, err := net.SplitHostPort(source.String()); err == nil {
+			clientIP = host
+		} else {
+			clientIP = source.String()
+		}
+	}
+
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		cs := tlsConn.ConnectionState()
+		tlsState = &cs
+	}
+
+	opt.HARRecorder.Record(capture.Finish(session.response, clientIP, tlsState))
+}
+
+// handleHARRequest serves the /har, /har (DELETE) and /har/live endpoints
+// hijacked by the api-host handler. It returns false if the path isn't a HAR
+// endpoint, so the caller can fall through to its normal 404 handling.
+func handleHARRequest(session *Session, opt *Option) (bool, error) {
+	if opt.HARRecorder == nil {
+		return false, nil
+	}
+
+	switch session.request.URL.Path {
+	case "/har":
+		if session.request.Method == http.MethodDelete {
+			opt.HARRecorder.Clear()
+			session.response = session.NewResponse(http.StatusNoContent, http.NoBody)
+			return true, session.response.Write(session.conn)
+		}
+
+		var buf bytes.Buffer
+		if err := har.WriteHAR(&buf, opt.HARRecorder.Entries()); err != nil {
+			return true, err
+		}
+
+		session.response = session.NewResponse(http.StatusOK, bytes.NewReader(buf.Bytes()))
+		session.response.Header.Set("Content-Type", "application/json")
+		session.response.ContentLength = int64(buf.Len())
+		return true, session.response.Write(session.conn)
+	case "/har/live":
+		return true, streamHARLive(session, opt)
+	}
+
+	return false, nil
+}
+
+// streamHARLive writes each newly recorded entry to the client as one NDJSON
+// line as soon as it's captured, until the client disconnects. The stream
+// has no Content-Length and relies on the connection closing to terminate,
+// same as a typical event-stream feed.
+func streamHARLive(session *Session, opt *Option) error {
+	header := "HTTP/1.1 200 OK\r\nContent-Type: application/x-ndjson\r\nConnection: close\r\n\r\n"
+	if _, err := session.conn.Write([]byte(header)); err != nil {
+		return err
+	}
+
+	ch := make(chan *har.Entry, 16)
+	cancel := opt.HARRecorder.Subscribe(ch)
+	defer cancel()
+
+	for e := range ch {
+		if err := har.WriteEntry(session.conn, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package har
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// creator identifies Clash.Meta as the generating tool, per the HAR 1.2
+// spec's "creator" object.
+var creator = struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}{Name: "Clash.Meta", Version: "1.0"}
+
+// harLog is the HAR 1.2 top-level envelope.
+type harLog struct {
+	Log struct {
+		Version string `json:"version"`
+		Creator interface{} `json:"creator"`
+		Entries []*Entry    `json:"entries"`
+	} `json:"log"`
+}
+
+// WriteHAR serializes entries as a complete HAR 1.2 document.
+func WriteHAR(w io.Writer, entries []*Entry) error {
+	doc := harLog{}
+	doc.Log.Version = "1.2"
+	doc.Log.Creator = creator
+	doc.Log.Entries = entries
+
+	return json.NewEncoder(w).Encode(doc)
+}
+
+// WriteEntry writes a single entry as one NDJSON line, used by the /har/live
+// streaming endpoint.
+func WriteEntry(w io.Writer, e *Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
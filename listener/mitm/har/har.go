@@ -0,0 +1,166 @@
+// Package har records intercepted MITM request/response pairs and exports
+// them as HAR 1.2 (HTTP Archive) logs, the same format produced by browser
+// devtools and tools like Charles or Fiddler.
+package har
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Entry is one recorded request/response pair, roughly mirroring the HAR
+// 1.2 "entry" object.
+type Entry struct {
+	StartedDateTime time.Time     `json:"startedDateTime"`
+	Time            float64       `json:"time"`
+	Request         Request       `json:"request"`
+	Response        Response      `json:"response"`
+	Timings         Timings       `json:"timings"`
+	ServerIPAddress string        `json:"serverIPAddress,omitempty"`
+	ClientIPAddress string        `json:"_clientIPAddress,omitempty"`
+	Connection      string        `json:"connection,omitempty"`
+	TLS             *TLSInfo      `json:"_tls,omitempty"`
+	bytes           int
+}
+
+// Timings records the phases this package can actually observe: time spent
+// waiting for the first response byte and time spent streaming the rest.
+type Timings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// TLSInfo summarizes the handshake seen on the intercepted connection.
+type TLSInfo struct {
+	Version          string `json:"version"`
+	CipherSuite      string `json:"cipherSuite"`
+	NegotiatedProto  string `json:"negotiatedProtocol,omitempty"`
+	ServerName       string `json:"serverName,omitempty"`
+	PeerCertSubject  string `json:"peerCertificateSubject,omitempty"`
+}
+
+// Request mirrors the HAR "request" object.
+type Request struct {
+	Method      string   `json:"method"`
+	URL         string   `json:"url"`
+	HTTPVersion string   `json:"httpVersion"`
+	Headers     []Header `json:"headers"`
+	HeadersSize int64    `json:"headersSize"`
+	BodySize    int64    `json:"bodySize"`
+	PostData    *Body    `json:"postData,omitempty"`
+}
+
+// Response mirrors the HAR "response" object.
+type Response struct {
+	Status      int      `json:"status"`
+	StatusText  string   `json:"statusText"`
+	HTTPVersion string   `json:"httpVersion"`
+	Headers     []Header `json:"headers"`
+	HeadersSize int64    `json:"headersSize"`
+	BodySize    int64    `json:"bodySize"`
+	Content     Body     `json:"content"`
+}
+
+// Header is a single HAR name/value header entry.
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Body holds a captured body, base64-encoded unless its Content-Type is
+// textual and it carries no Content-Encoding (see newBody).
+type Body struct {
+	MimeType string `json:"mimeType"`
+	Size     int64  `json:"size"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+func headersToHAR(h http.Header) []Header {
+	out := make([]Header, 0, len(h))
+	for name, values := range h {
+		for _, v := range values {
+			out = append(out, Header{Name: name, Value: v})
+		}
+	}
+
+	return out
+}
+
+// newBody builds a captured Body. contentEncoding is the Content-Encoding
+// header of whatever body data came from: when non-empty, data is still the
+// compressed wire bytes (this package never decodes a body just to record
+// it), so it's always base64-encoded regardless of contentType, since
+// treating compressed bytes as text would silently corrupt them.
+func newBody(contentType, contentEncoding string, data []byte) Body {
+	b := Body{
+		MimeType: contentType,
+		Size:     int64(len(data)),
+	}
+
+	if contentEncoding == "" && isTextual(contentType) {
+		b.Text = string(data)
+	} else {
+		b.Encoding = "base64"
+		b.Text = base64.StdEncoding.EncodeToString(data)
+	}
+
+	return b
+}
+
+func isTextual(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mt = contentType
+	}
+
+	return strings.HasPrefix(mt, "text/") ||
+		strings.Contains(mt, "json") ||
+		strings.Contains(mt, "xml") ||
+		strings.Contains(mt, "javascript") ||
+		strings.Contains(mt, "x-www-form-urlencoded")
+}
+
+func tlsInfo(cs *tls.ConnectionState) *TLSInfo {
+	if cs == nil {
+		return nil
+	}
+
+	info := &TLSInfo{
+		Version:         tlsVersionName(cs.Version),
+		CipherSuite:     tls.CipherSuiteName(cs.CipherSuite),
+		NegotiatedProto: cs.NegotiatedProtocol,
+		ServerName:      cs.ServerName,
+	}
+
+	if len(cs.PeerCertificates) > 0 {
+		info.PeerCertSubject = subjectName(cs.PeerCertificates[0])
+	}
+
+	return info
+}
+
+func subjectName(cert *x509.Certificate) string {
+	return cert.Subject.CommonName
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,243 @@
+package har
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// maxCapturedBody caps how much of any single body is copied into an Entry.
+// Bodies larger than this are still proxied in full; only the HAR record is
+// truncated.
+const maxCapturedBody = 1 << 20 // 1MiB
+
+// Recorder accumulates Entry values in a ring buffer bounded by both entry
+// count and total captured bytes, so a long-running capture can't grow
+// without limit. It is safe for concurrent use.
+type Recorder struct {
+	mu          sync.Mutex
+	maxEntries  int
+	maxBytes    int
+	entries     []*Entry
+	bytes       int
+	subscribers map[chan *Entry]struct{}
+}
+
+// NewRecorder creates a Recorder bounded by maxEntries entries and maxBytes
+// of captured request+response body content, whichever is hit first.
+func NewRecorder(maxEntries, maxBytes int) *Recorder {
+	return &Recorder{
+		maxEntries:  maxEntries,
+		maxBytes:    maxBytes,
+		subscribers: make(map[chan *Entry]struct{}),
+	}
+}
+
+// Record appends e to the log, evicting the oldest entries as needed to
+// respect the configured bounds, and fans it out to any /har/live
+// subscribers.
+func (r *Recorder) Record(e *Entry) {
+	r.mu.Lock()
+	r.entries = append(r.entries, e)
+	r.bytes += e.bytes
+
+	for (len(r.entries) > r.maxEntries && r.maxEntries > 0) || (r.bytes > r.maxBytes && r.maxBytes > 0) {
+		if len(r.entries) == 0 {
+			break
+		}
+		r.bytes -= r.entries[0].bytes
+		r.entries = r.entries[1:]
+	}
+
+	subs := make([]chan *Entry, 0, len(r.subscribers))
+	for ch := range r.subscribers {
+		subs = append(subs, ch)
+	}
+	r.mu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- e:
+		default: // slow subscriber, drop rather than block the capture path
+		}
+	}
+}
+
+// Entries returns a snapshot of the currently retained entries.
+func (r *Recorder) Entries() []*Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]*Entry, len(r.entries))
+	copy(out, r.entries)
+
+	return out
+}
+
+// Clear empties the log.
+func (r *Recorder) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries = nil
+	r.bytes = 0
+}
+
+// Subscribe registers ch to receive every Entry recorded from now on. The
+// returned cancel func must be called to unregister it.
+func (r *Recorder) Subscribe(ch chan *Entry) (cancel func()) {
+	r.mu.Lock()
+	r.subscribers[ch] = struct{}{}
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.subscribers, ch)
+		r.mu.Unlock()
+	}
+}
+
+// Capture tracks timing and buffered bodies for one request/response pair as
+// it passes through the MITM listener.
+type Capture struct {
+	request   *http.Request
+	reqBody   *boundedBuffer
+	resBody   *boundedBuffer
+	started   time.Time
+	firstByte time.Time
+	serverIP  string
+}
+
+// Trace returns a copy of ctx instrumented to record the remote address of
+// whatever connection the eventual client.Do ends up dialing or reusing, so
+// Finish can report the real upstream address instead of the client-facing
+// one.
+func (c *Capture) Trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Conn == nil {
+				return
+			}
+			if host, _, err := net.SplitHostPort(info.Conn.RemoteAddr().String()); err == nil {
+				c.serverIP = host
+			}
+		},
+	})
+}
+
+// Begin starts capturing request, copying up to maxCapturedBody bytes of its
+// body as it's read so the proxied request can still read the rest.
+func Begin(request *http.Request) *Capture {
+	c := &Capture{request: request, started: time.Now()}
+
+	if request.Body != nil {
+		c.reqBody = &boundedBuffer{limit: maxCapturedBody}
+		request.Body = &teeReadCloser{r: io.TeeReader(request.Body, c.reqBody), c: request.Body}
+	}
+
+	return c
+}
+
+type boundedBuffer struct {
+	data  []byte
+	limit int
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	if len(b.data) < b.limit {
+		n := b.limit - len(b.data)
+		if n > len(p) {
+			n = len(p)
+		}
+		b.data = append(b.data, p[:n]...)
+	}
+
+	return len(p), nil
+}
+
+type teeReadCloser struct {
+	r io.Reader
+	c io.Closer
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) { return t.r.Read(p) }
+func (t *teeReadCloser) Close() error                { return t.c.Close() }
+
+// Respond marks the moment the response headers became available and tees
+// up to maxCapturedBody bytes of its body into the capture as it's read, the
+// same tee-while-streaming approach Begin uses for the request body. This
+// way a long-lived response (e.g. SSE) is never held back waiting for a
+// snapshot to fill before the client sees any of it.
+func (c *Capture) Respond(response *http.Response) {
+	c.firstByte = time.Now()
+
+	if response == nil || response.Body == nil {
+		return
+	}
+
+	c.resBody = &boundedBuffer{limit: maxCapturedBody}
+	response.Body = &teeReadCloser{r: io.TeeReader(response.Body, c.resBody), c: response.Body}
+}
+
+// Finish builds the Entry for this capture. response is the final (possibly
+// handler-rewritten) response; it must have already been fully streamed to
+// the client so the bodies teed by Begin/Respond are complete. clientIP is
+// the intercepted client's address (as opposed to c.serverIP, the upstream
+// address recorded by Trace).
+func (c *Capture) Finish(response *http.Response, clientIP string, tlsState *tls.ConnectionState) *Entry {
+	now := time.Now()
+
+	var reqBody []byte
+	if c.reqBody != nil {
+		reqBody = c.reqBody.data
+	}
+
+	var resBody []byte
+	if c.resBody != nil {
+		resBody = c.resBody.data
+	}
+
+	entry := &Entry{
+		StartedDateTime: c.started,
+		Time:            now.Sub(c.started).Seconds() * 1000,
+		ServerIPAddress: c.serverIP,
+		ClientIPAddress: clientIP,
+		TLS:             tlsInfo(tlsState),
+		Timings: Timings{
+			Wait:    c.firstByte.Sub(c.started).Seconds() * 1000,
+			Receive: now.Sub(c.firstByte).Seconds() * 1000,
+		},
+		Request: Request{
+			Method:      c.request.Method,
+			URL:         c.request.URL.String(),
+			HTTPVersion: c.request.Proto,
+			Headers:     headersToHAR(c.request.Header),
+			BodySize:    int64(len(reqBody)),
+		},
+	}
+
+	if len(reqBody) > 0 {
+		body := newBody(c.request.Header.Get("Content-Type"), c.request.Header.Get("Content-Encoding"), reqBody)
+		entry.Request.PostData = &body
+	}
+
+	if response != nil {
+		entry.Response = Response{
+			Status:      response.StatusCode,
+			StatusText:  http.StatusText(response.StatusCode),
+			HTTPVersion: response.Proto,
+			Headers:     headersToHAR(response.Header),
+			BodySize:    int64(len(resBody)),
+			Content:     newBody(response.Header.Get("Content-Type"), response.Header.Get("Content-Encoding"), resBody),
+		}
+	}
+
+	entry.bytes = len(reqBody) + len(resBody)
+
+	return entry
+}
@@ -0,0 +1,236 @@
+package mitm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/Dreamacro/clash/adapter/inbound"
+	N "github.com/Dreamacro/clash/common/net"
+	"github.com/Dreamacro/clash/component/process"
+	C "github.com/Dreamacro/clash/constant"
+	"github.com/Dreamacro/clash/listener/mitm/policy"
+	"github.com/Dreamacro/clash/log"
+)
+
+// policyMetadata builds the policy.Metadata a rule matches against for a
+// CONNECT target in "host:port" form. source, when it's a *net.TCPAddr, is
+// used to look up the local process that owns the connection, for
+// PROCESS-NAME rules.
+func policyMetadata(hostname string, source net.Addr) *policy.Metadata {
+	host, _, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host = hostname
+	}
+
+	meta := &policy.Metadata{Host: host}
+	if ip := net.ParseIP(host); ip != nil {
+		meta.IP = ip
+	}
+
+	if tcpAddr, ok := source.(*net.TCPAddr); ok {
+		if name, err := process.FindProcessName("tcp", tcpAddr.IP, tcpAddr.Port); err == nil {
+			meta.Process = name
+		}
+	}
+
+	return meta
+}
+
+// shouldMitm reports whether hostname should be decrypted. When opt.Policy
+// is configured it defers entirely to the engine's decision (already
+// consulted by the caller for the other actions); otherwise it falls back to
+// the original port-based heuristic.
+func shouldMitm(hostname string, source net.Addr, opt *Option) bool {
+	if opt.Policy != nil {
+		return opt.Policy.Decide(policyMetadata(hostname, source)) == policy.Mitm
+	}
+
+	return couldBeWithManInTheMiddleAttack(hostname, opt)
+}
+
+// handlePolicyRulesRequest serves PUT /mitm/rules, replacing the active
+// policy engine's rule set with one parsed from the request body. Each line
+// is "RULE-TYPE,payload,action", the same shape used by Clash's own rule
+// providers. It returns false when the request isn't for this endpoint.
+func handlePolicyRulesRequest(session *Session, opt *Option) (bool, error) {
+	if session.request.URL.Path != "/mitm/rules" {
+		return false, nil
+	}
+
+	if opt.Policy == nil || session.request.Method != http.MethodPut {
+		session.response = session.NewResponse(http.StatusNotFound, http.NoBody)
+		return true, session.response.Write(session.conn)
+	}
+
+	body, err := io.ReadAll(session.request.Body)
+	if err != nil {
+		return true, err
+	}
+
+	rules, err := parsePolicyRules(body)
+	if err != nil {
+		session.response = session.NewErrorResponse(err)
+		return true, session.response.Write(session.conn)
+	}
+
+	opt.Policy.Replace(rules)
+
+	session.response = session.NewResponse(http.StatusNoContent, http.NoBody)
+	return true, session.response.Write(session.conn)
+}
+
+func parsePolicyRules(body []byte) ([]policy.Rule, error) {
+	var rules []policy.Rule
+
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, ",", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("mitm: malformed rule line %q", line)
+		}
+
+		rule, err := policy.ParseRule(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), strings.TrimSpace(parts[2]))
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+// handleObserveConnect peeks the ClientHello's SNI for logging, then passes
+// the connection through undecrypted. ALPN is not extracted or logged.
+func handleObserveConnect(session *Session, in chan<- C.ConnContext) {
+	b := make([]byte, 1)
+	if _, err := session.conn.Read(b); err != nil {
+		return
+	}
+
+	rest := make([]byte, session.conn.(*N.BufferedConn).Buffered())
+	_, _ = session.conn.Read(rest)
+
+	record := append(b, rest...)
+	mc := &MultiReaderConn{
+		Conn:   session.conn,
+		reader: io.MultiReader(bytes.NewReader(record), session.conn),
+	}
+
+	if sni, err := peekClientHelloSNI(record); err == nil {
+		log.Infoln("[MITM] observed ClientHello for %s (SNI=%s)", session.request.URL.Host, sni)
+	} else {
+		log.Infoln("[MITM] observed connection to %s: %v", session.request.URL.Host, err)
+	}
+
+	passThroughRaw(session.request, mc, in)
+}
+
+// passThroughRaw hands conn off to Clash's own dialer via the in channel,
+// the same passthrough proxy.go already uses for "maybe it's the others
+// encrypted connection". Used for policy.Bypass and, after peeking the SNI,
+// policy.Observe, so bypassed/observed traffic still goes through Clash's
+// rule-based outbound selection instead of a raw net.Dial.
+func passThroughRaw(request *http.Request, conn net.Conn, in chan<- C.ConnContext) {
+	in <- inbound.NewHTTPS(request, conn)
+}
+
+// peekClientHelloSNI extracts the server_name extension from a single,
+// unfragmented TLS ClientHello record. It's a best-effort parse intended
+// only for the "observe" policy's logging, not a general TLS parser.
+func peekClientHelloSNI(record []byte) (string, error) {
+	// TLS record header: type(1) version(2) length(2)
+	if len(record) < 5 || record[0] != 22 {
+		return "", errors.New("mitm: not a TLS handshake record")
+	}
+
+	body := record[5:]
+	// Handshake header: msg type(1) length(3)
+	if len(body) < 4 || body[0] != 1 {
+		return "", errors.New("mitm: not a ClientHello")
+	}
+
+	p := body[4:]
+	// version(2) + random(32)
+	if len(p) < 34 {
+		return "", errors.New("mitm: truncated ClientHello")
+	}
+	p = p[34:]
+
+	p, err := skipLengthPrefixed(p, 1) // session id
+	if err != nil {
+		return "", err
+	}
+	p, err = skipLengthPrefixed(p, 2) // cipher suites
+	if err != nil {
+		return "", err
+	}
+	p, err = skipLengthPrefixed(p, 1) // compression methods
+	if err != nil {
+		return "", err
+	}
+
+	if len(p) < 2 {
+		return "", errors.New("mitm: ClientHello has no extensions")
+	}
+	extLen := binary.BigEndian.Uint16(p[:2])
+	p = p[2:]
+	if len(p) < int(extLen) {
+		return "", errors.New("mitm: truncated extensions")
+	}
+	extensions := p[:extLen]
+
+	for len(extensions) >= 4 {
+		extType := binary.BigEndian.Uint16(extensions[:2])
+		extBodyLen := binary.BigEndian.Uint16(extensions[2:4])
+		extensions = extensions[4:]
+		if len(extensions) < int(extBodyLen) {
+			return "", errors.New("mitm: truncated extension body")
+		}
+		extBody := extensions[:extBodyLen]
+		extensions = extensions[extBodyLen:]
+
+		if extType != 0 { // server_name
+			continue
+		}
+
+		if len(extBody) < 5 {
+			return "", errors.New("mitm: truncated server_name extension")
+		}
+		nameLen := binary.BigEndian.Uint16(extBody[3:5])
+		if len(extBody) < int(5+nameLen) {
+			return "", errors.New("mitm: truncated server name")
+		}
+		return string(extBody[5 : 5+nameLen]), nil
+	}
+
+	return "", errors.New("mitm: no server_name extension")
+}
+
+func skipLengthPrefixed(p []byte, lenBytes int) ([]byte, error) {
+	if len(p) < lenBytes {
+		return nil, errors.New("mitm: truncated ClientHello field")
+	}
+
+	var n int
+	for i := 0; i < lenBytes; i++ {
+		n = n<<8 | int(p[i])
+	}
+	p = p[lenBytes:]
+
+	if len(p) < n {
+		return nil, errors.New("mitm: truncated ClientHello field")
+	}
+
+	return p[n:], nil
+}
@@ -0,0 +1,191 @@
+// Package policy decides, per intercepted host, whether the MITM listener
+// should decrypt it, tunnel it raw, reject it outright, or just peek its SNI.
+// Rules use the same RULE-TYPE,payload,action shape as Clash's proxy rules.
+package policy
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Action is the decision a matched (or default) rule produces.
+type Action string
+
+const (
+	// Mitm decrypts the connection and hands it to the configured handler,
+	// the existing default behaviour.
+	Mitm Action = "mitm"
+	// Bypass tunnels the connection raw, byte for byte, without decrypting.
+	Bypass Action = "bypass"
+	// Reject closes the connection immediately.
+	Reject Action = "reject"
+	// Observe peeks the ClientHello for its SNI, logs it, then splices the
+	// connection raw — useful for hosts with certificate pinning where a
+	// full MITM would break the app. The ALPN list is not parsed or logged.
+	Observe Action = "observe"
+)
+
+// Metadata is everything a Rule can match against. Fields that can't be
+// determined for a given connection are left zero.
+type Metadata struct {
+	Host    string // hostname, without port
+	IP      net.IP
+	Process string
+}
+
+// Rule matches a subset of connections described by Metadata.
+type Rule interface {
+	Match(meta *Metadata) bool
+	Action() Action
+	RuleType() string
+	Payload() string
+}
+
+type baseRule struct {
+	action  Action
+	payload string
+}
+
+func (r baseRule) Action() Action  { return r.action }
+func (r baseRule) Payload() string { return r.payload }
+
+type domainSuffixRule struct {
+	baseRule
+	suffix string
+}
+
+func (r *domainSuffixRule) RuleType() string { return "DOMAIN-SUFFIX" }
+func (r *domainSuffixRule) Match(meta *Metadata) bool {
+	return meta.Host != "" && (meta.Host == r.suffix || strings.HasSuffix(meta.Host, "."+r.suffix))
+}
+
+type domainKeywordRule struct {
+	baseRule
+	keyword string
+}
+
+func (r *domainKeywordRule) RuleType() string { return "DOMAIN-KEYWORD" }
+func (r *domainKeywordRule) Match(meta *Metadata) bool {
+	return meta.Host != "" && strings.Contains(meta.Host, r.keyword)
+}
+
+type domainRegexRule struct {
+	baseRule
+	re *regexp.Regexp
+}
+
+func (r *domainRegexRule) RuleType() string { return "DOMAIN-REGEX" }
+func (r *domainRegexRule) Match(meta *Metadata) bool {
+	return meta.Host != "" && r.re.MatchString(meta.Host)
+}
+
+type ipCIDRRule struct {
+	baseRule
+	cidr *net.IPNet
+}
+
+func (r *ipCIDRRule) RuleType() string { return "IP-CIDR" }
+func (r *ipCIDRRule) Match(meta *Metadata) bool {
+	return meta.IP != nil && r.cidr.Contains(meta.IP)
+}
+
+type processNameRule struct {
+	baseRule
+	name string
+}
+
+func (r *processNameRule) RuleType() string { return "PROCESS-NAME" }
+func (r *processNameRule) Match(meta *Metadata) bool {
+	return meta.Process != "" && strings.EqualFold(meta.Process, r.name)
+}
+
+// ParseRule parses one RULE-TYPE,payload,action line into a Rule.
+func ParseRule(ruleType, payload, action string) (Rule, error) {
+	act := Action(strings.ToLower(action))
+	switch act {
+	case Mitm, Bypass, Reject, Observe:
+	default:
+		return nil, fmt.Errorf("policy: unsupported action %q", action)
+	}
+
+	base := baseRule{action: act, payload: payload}
+
+	switch strings.ToUpper(ruleType) {
+	case "DOMAIN-SUFFIX":
+		return &domainSuffixRule{baseRule: base, suffix: strings.ToLower(payload)}, nil
+	case "DOMAIN-KEYWORD":
+		return &domainKeywordRule{baseRule: base, keyword: strings.ToLower(payload)}, nil
+	case "DOMAIN-REGEX":
+		re, err := regexp.Compile(payload)
+		if err != nil {
+			return nil, fmt.Errorf("policy: invalid DOMAIN-REGEX %q: %w", payload, err)
+		}
+		return &domainRegexRule{baseRule: base, re: re}, nil
+	case "IP-CIDR":
+		_, cidr, err := net.ParseCIDR(payload)
+		if err != nil {
+			return nil, fmt.Errorf("policy: invalid IP-CIDR %q: %w", payload, err)
+		}
+		return &ipCIDRRule{baseRule: base, cidr: cidr}, nil
+	case "PROCESS-NAME":
+		return &processNameRule{baseRule: base, name: payload}, nil
+	default:
+		return nil, fmt.Errorf("policy: unsupported rule type %q", ruleType)
+	}
+}
+
+// Engine is an ordered set of Rules plus a default Action for anything none
+// of them match. It supports hot-reload: Replace swaps the active rule set
+// atomically so lookups never observe a half-updated state.
+type Engine struct {
+	mu      sync.RWMutex
+	rules   []Rule
+	fallback Action
+}
+
+// NewEngine creates an Engine that applies fallback when no rule matches.
+// An empty fallback means Mitm (the pre-existing behaviour).
+func NewEngine(fallback Action) *Engine {
+	if fallback == "" {
+		fallback = Mitm
+	}
+
+	return &Engine{fallback: fallback}
+}
+
+// Replace atomically swaps in a new rule set, e.g. after a config reload or
+// a PUT to the hot-reload API.
+func (e *Engine) Replace(rules []Rule) {
+	e.mu.Lock()
+	e.rules = rules
+	e.mu.Unlock()
+}
+
+// Decide returns the Action for meta: the first matching rule's action, or
+// the engine's fallback if none match.
+func (e *Engine) Decide(meta *Metadata) Action {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, rule := range e.rules {
+		if rule.Match(meta) {
+			return rule.Action()
+		}
+	}
+
+	return e.fallback
+}
+
+// Rules returns the currently active rule set.
+func (e *Engine) Rules() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	out := make([]Rule, len(e.rules))
+	copy(out, e.rules)
+
+	return out
+}
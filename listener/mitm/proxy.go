@@ -18,6 +18,8 @@ import (
 	N "github.com/Dreamacro/clash/common/net"
 	C "github.com/Dreamacro/clash/constant"
 	httpL "github.com/Dreamacro/clash/listener/http"
+	"github.com/Dreamacro/clash/listener/mitm/har"
+	"github.com/Dreamacro/clash/listener/mitm/policy"
 )
 
 func HandleConn(c net.Conn, opt *Option, in chan<- C.ConnContext, cache *cache.Cache[string, bool]) {
@@ -57,6 +59,7 @@ readLoop:
 		}
 
 		var response *http.Response
+		var capture *har.Capture
 
 		session := NewSession(conn, request, response)
 
@@ -77,7 +80,20 @@ readLoop:
 					break readLoop // close connection
 				}
 
-				if couldBeWithManInTheMiddleAttack(session.request.URL.Host, opt) {
+				if opt.Policy != nil {
+					switch opt.Policy.Decide(policyMetadata(session.request.URL.Host, source)) {
+					case policy.Reject:
+						break readLoop // close connection
+					case policy.Bypass:
+						passThroughRaw(session.request, session.conn, in)
+						break readLoop
+					case policy.Observe:
+						handleObserveConnect(session, in)
+						break readLoop
+					}
+				}
+
+				if shouldMitm(session.request.URL.Host, source, opt) {
 					b := make([]byte, 1)
 					if _, err = session.conn.Read(b); err != nil {
 						handleError(opt, session, err)
@@ -96,7 +112,9 @@ readLoop:
 					// https://tools.ietf.org/html/rfc5246#section-6.2.1
 					if b[0] == 22 {
 						// TODO serve by generic host name maybe better?
-						tlsConn := tls.Server(mc, opt.CertConfig.NewTLSConfigForHost(session.request.URL.Host))
+						tlsConfig := opt.CertConfig.NewTLSConfigForHost(session.request.URL.Host)
+						tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+						tlsConn := tls.Server(mc, tlsConfig)
 
 						// Handshake with the local client
 						if err = tlsConn.Handshake(); err != nil {
@@ -104,6 +122,11 @@ readLoop:
 							break readLoop // close connection
 						}
 
+						if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+							serveH2(tlsConn, opt, in, source)
+							break readLoop // h2 owns the connection from here on
+						}
+
 						c = tlsConn
 						goto startOver // hijack and decrypt tls connection
 					}
@@ -125,7 +148,15 @@ readLoop:
 				return
 			}
 
-			prepareRequest(c, session.request)
+			prepareRequest(c, session.request, session, opt)
+			applyRequestStream(session, opt)
+
+			if handled, err := handleUpgrade(session, opt, source, in); handled {
+				if err != nil {
+					handleError(opt, session, err)
+				}
+				break readLoop // connection was tunneled (or failed) as an upgrade, not plain HTTP
+			}
 
 			// hijack custom request and write back custom response if necessary
 			if opt.Handler != nil {
@@ -149,6 +180,11 @@ readLoop:
 
 			session.request.RequestURI = ""
 
+			if opt.HARRecorder != nil {
+				capture = har.Begin(session.request)
+				session.request = session.request.WithContext(capture.Trace(session.request.Context()))
+			}
+
 			if session.request.URL.Scheme == "" || session.request.URL.Host == "" {
 				session.response = session.NewErrorResponse(errors.New("invalid URL"))
 			} else {
@@ -165,12 +201,20 @@ readLoop:
 					}
 				}
 			}
+
+			if capture != nil {
+				beginResponseCapture(capture, session)
+			}
 		}
 
 		if err = writeResponseWithHandler(session, opt); err != nil {
 			handleError(opt, session, err)
 			break readLoop // close connection
 		}
+
+		if capture != nil {
+			recordHAR(opt, capture, session, c, source)
+		}
 	}
 
 	_ = conn.Close()
@@ -190,6 +234,12 @@ func writeResponseWithHandler(session *Session, opt *Option) error {
 		}
 	}
 
+	if !shouldPassThrough(session, opt) {
+		if err := applyResponseStream(session, opt); err != nil {
+			return err
+		}
+	}
+
 	return writeResponse(session, true)
 }
 
@@ -207,6 +257,14 @@ func writeResponse(session *Session, keepAlive bool) error {
 }
 
 func handleApiRequest(session *Session, opt *Option) error {
+	if handled, err := handleHARRequest(session, opt); handled {
+		return err
+	}
+
+	if handled, err := handlePolicyRulesRequest(session, opt); handled {
+		return err
+	}
+
 	if opt.CertConfig != nil && strings.ToLower(session.request.URL.Path) == "/cert.crt" {
 		b := pem.EncodeToMemory(&pem.Block{
 			Type:  "CERTIFICATE",
@@ -267,7 +325,7 @@ func handleError(opt *Option, session *Session, err error) {
 	// log.Errorln("[MITM] process mitm error: %v", err)
 }
 
-func prepareRequest(conn net.Conn, request *http.Request) {
+func prepareRequest(conn net.Conn, request *http.Request, session *Session, opt *Option) {
 	host := request.Header.Get("Host")
 	if host != "" {
 		request.Host = host
@@ -286,7 +344,8 @@ func prepareRequest(conn net.Conn, request *http.Request) {
 		request.URL.Scheme = "https"
 	}
 
-	if request.Header.Get("Accept-Encoding") != "" {
+	acceptEncoding := request.Header.Get("Accept-Encoding")
+	if acceptEncoding != "" && !shouldPassThrough(session, opt) {
 		request.Header.Set("Accept-Encoding", "gzip")
 	}
 }
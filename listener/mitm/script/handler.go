@@ -0,0 +1,118 @@
+package script
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Dreamacro/clash/listener/mitm"
+	"github.com/Dreamacro/clash/log"
+)
+
+// Handler implements mitm.Handler (and its optional
+// mitm.WebSocketFrameHandler extension) by dispatching to whichever loaded
+// scripts match the session's URL.
+type Handler struct {
+	Manager *Manager
+	Client  *http.Client
+}
+
+// NewHandler loads every *.js file in scriptsDir and returns a Handler ready
+// to be set as mitm.Option.Handler.
+func NewHandler(scriptsDir string, client *http.Client) (*Handler, error) {
+	m := NewManager(scriptsDir)
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+
+	return &Handler{Manager: m, Client: client}, nil
+}
+
+func (h *Handler) HandleRequest(session *mitm.Session) (*http.Request, *http.Response) {
+	req := session.Request()
+
+	for _, s := range h.Manager.Match(req.URL.String()) {
+		newReq, newRes, err := runRequestScript(s.Source, req, h.Client)
+		if err != nil {
+			log.Warnln("[Script] %s: %v", s.Name, err)
+			continue
+		}
+		if newReq != nil || newRes != nil {
+			return newReq, newRes
+		}
+	}
+
+	return nil, nil
+}
+
+func (h *Handler) HandleResponse(session *mitm.Session) *http.Response {
+	res := session.Response()
+	if res == nil {
+		return nil
+	}
+
+	for _, s := range h.Manager.Match(res.Request.URL.String()) {
+		newRes, err := runResponseScript(s.Source, res, h.Client)
+		if err != nil {
+			log.Warnln("[Script] %s: %v", s.Name, err)
+			continue
+		}
+		if newRes != nil {
+			return newRes
+		}
+	}
+
+	return nil
+}
+
+func (h *Handler) HandleWebSocketFrame(session *mitm.Session, frame []byte, fromClient bool) []byte {
+	req := session.Request()
+
+	for _, s := range h.Manager.Match(req.URL.String()) {
+		rewritten, err := runFrameScript(s.Source, string(frame), fromClient)
+		if err != nil {
+			log.Warnln("[Script] %s: %v", s.Name, err)
+			continue
+		}
+		if rewritten != string(frame) {
+			return []byte(rewritten)
+		}
+	}
+
+	return nil
+}
+
+func (h *Handler) HandleApiRequest(session *mitm.Session) bool {
+	req := session.Request()
+	if req.URL.Path != "/scripts" {
+		return false
+	}
+
+	if req.Method == http.MethodPost {
+		if err := h.Manager.Reload(); err != nil {
+			_ = session.WriteResponse(session.NewErrorResponse(err))
+			return true
+		}
+	}
+
+	b, _ := json.Marshal(scriptNames(h.Manager.List()))
+	res := session.NewResponse(http.StatusOK, bytes.NewReader(b))
+	res.Header.Set("Content-Type", "application/json")
+	res.ContentLength = int64(len(b))
+	_ = session.WriteResponse(res)
+
+	return true
+}
+
+func (h *Handler) HandleError(session *mitm.Session, err error) {
+	log.Warnln("[Script] %v", err)
+}
+
+func scriptNames(scripts []*Script) []string {
+	names := make([]string, 0, len(scripts))
+	for _, s := range scripts {
+		names = append(names, s.Name+" -> "+s.Pattern)
+	}
+
+	return names
+}
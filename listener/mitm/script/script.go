@@ -0,0 +1,150 @@
+// Package script lets MITM sessions be rewritten by small JavaScript files,
+// Surge/Quantumult-style, without recompiling Go. Scripts are plain .js
+// files dropped into a directory and matched to requests by URL pattern.
+package script
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Script is one loaded rewrite script.
+type Script struct {
+	Name    string // file name, without directory
+	Pattern string // glob matched against the request URL
+	Source  string // raw JS source
+}
+
+// patternFromSource reads a leading "// pattern: <glob>" comment, falling
+// back to "*" (match everything) when absent.
+func patternFromSource(source string) string {
+	const prefix = "// pattern:"
+
+	scanner := bufio.NewScanner(strings.NewReader(source))
+	if scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(line[len(prefix):])
+		}
+	}
+
+	return "*"
+}
+
+func loadScript(file string) (*Script, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	source := string(data)
+
+	return &Script{
+		Name:    filepath.Base(file),
+		Pattern: patternFromSource(source),
+		Source:  source,
+	}, nil
+}
+
+// Manager loads and hot-reloads the scripts in a directory, and matches
+// sessions to them by URL pattern.
+type Manager struct {
+	dir string
+
+	mu      sync.RWMutex
+	scripts []*Script
+}
+
+// NewManager creates a Manager for scriptsDir. Call Reload to (re)load it.
+func NewManager(scriptsDir string) *Manager {
+	return &Manager{dir: scriptsDir}
+}
+
+// Reload re-reads every *.js file in the scripts directory, replacing the
+// active set atomically.
+func (m *Manager) Reload() error {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+
+	scripts := make([]*Script, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".js") {
+			continue
+		}
+
+		s, err := loadScript(filepath.Join(m.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		scripts = append(scripts, s)
+	}
+
+	m.mu.Lock()
+	m.scripts = scripts
+	m.mu.Unlock()
+
+	return nil
+}
+
+// List returns the currently loaded scripts.
+func (m *Manager) List() []*Script {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make([]*Script, len(m.scripts))
+	copy(out, m.scripts)
+
+	return out
+}
+
+// Match returns every loaded script whose pattern matches url.
+func (m *Manager) Match(url string) []*Script {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var matched []*Script
+	for _, s := range m.scripts {
+		if globMatch(s.Pattern, url) {
+			matched = append(matched, s)
+		}
+	}
+
+	return matched
+}
+
+// globMatch reports whether url matches pattern, where "*" stands for any
+// run of characters (including "/") and "?" for exactly one. Unlike
+// path.Match/filepath.Match, "*" is not stopped by path separators, since
+// pattern is matched against a whole URL rather than a filesystem path.
+func globMatch(pattern, url string) bool {
+	re, err := regexp.Compile("^" + globToRegexp(pattern) + "$")
+	if err != nil {
+		return false
+	}
+
+	return re.MatchString(url)
+}
+
+func globToRegexp(pattern string) string {
+	var b strings.Builder
+
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,315 @@
+package script
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// scriptTimeout bounds how long a single script body may run. Scripts are
+// user-supplied .js files executed inline on the connection's goroutine, so
+// an accidental infinite loop must not be able to hang it forever.
+const scriptTimeout = 5 * time.Second
+
+// runScript runs source on vm with scriptTimeout enforced: if the script is
+// still running when the timer fires, vm.Interrupt aborts it and RunString
+// returns an error instead of blocking indefinitely.
+func runScript(vm *goja.Runtime, source string) (goja.Value, error) {
+	timer := time.AfterFunc(scriptTimeout, func() {
+		vm.Interrupt("script timeout")
+	})
+	defer timer.Stop()
+
+	return vm.RunString(source)
+}
+
+// jsRequest is the shape exposed to scripts as $request.
+type jsRequest struct {
+	URL     string
+	Method  string
+	Headers map[string]string
+	Body    string
+}
+
+// jsResponse is the shape exposed to scripts as $response, and accepted back
+// from $done({response: ...}).
+type jsResponse struct {
+	Status  int
+	Headers map[string]string
+	Body    string
+}
+
+// jsDone is whatever a script passes to $done().
+type jsDone struct {
+	Request  *jsRequest
+	Response *jsResponse
+}
+
+func newRuntime(client *http.Client) *goja.Runtime {
+	vm := goja.New()
+
+	_ = vm.Set("$fetch", func(call goja.FunctionCall) goja.Value {
+		return fetch(vm, client, call)
+	})
+
+	_ = vm.Set("$base64Encode", func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	})
+	_ = vm.Set("$base64Decode", func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	})
+
+	return vm
+}
+
+func fetch(vm *goja.Runtime, client *http.Client, call goja.FunctionCall) goja.Value {
+	if client == nil {
+		panic(vm.ToValue("$fetch: no client configured"))
+	}
+	if len(call.Arguments) == 0 {
+		panic(vm.ToValue("$fetch: missing url"))
+	}
+
+	url := call.Arguments[0].String()
+	method := http.MethodGet
+	var body io.Reader
+	headers := map[string]string{}
+
+	if len(call.Arguments) > 1 {
+		opts := call.Arguments[1].ToObject(vm)
+		if m := opts.Get("method"); m != nil && !goja.IsUndefined(m) {
+			method = m.String()
+		}
+		if b := opts.Get("body"); b != nil && !goja.IsUndefined(b) {
+			body = strings.NewReader(b.String())
+		}
+		if h := opts.Get("headers"); h != nil && !goja.IsUndefined(h) {
+			if hObj := h.ToObject(vm); hObj != nil {
+				for _, k := range hObj.Keys() {
+					headers[k] = hObj.Get(k).String()
+				}
+			}
+		}
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		panic(vm.ToValue(err.Error()))
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		panic(vm.ToValue(err.Error()))
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	respBody, _ := io.ReadAll(res.Body)
+
+	return vm.ToValue(map[string]interface{}{
+		"status":  res.StatusCode,
+		"headers": flattenHeader(res.Header),
+		"body":    string(respBody),
+	})
+}
+
+func flattenHeader(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		out[k] = strings.Join(v, ", ")
+	}
+
+	return out
+}
+
+// runRequestScript evaluates source against req, returning a replacement
+// request and/or response if the script called $done with one.
+func runRequestScript(source string, req *http.Request, client *http.Client) (*http.Request, *http.Response, error) {
+	vm := newRuntime(client)
+
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	var done *jsDone
+	_ = vm.Set("$done", func(v goja.Value) { done = parseDone(vm, v) })
+	_ = vm.Set("$request", map[string]interface{}{
+		"url":     req.URL.String(),
+		"method":  req.Method,
+		"headers": flattenHeader(req.Header),
+		"body":    string(body),
+	})
+
+	if _, err := runScript(vm, source); err != nil {
+		return nil, nil, err
+	}
+
+	if done == nil {
+		return nil, nil, nil
+	}
+
+	if done.Response != nil {
+		return nil, buildResponse(req, done.Response), nil
+	}
+	if done.Request != nil {
+		return applyRequest(req, done.Request), nil, nil
+	}
+
+	return nil, nil, nil
+}
+
+// runResponseScript evaluates source against res, returning a replacement
+// response if the script called $done with one.
+func runResponseScript(source string, res *http.Response, client *http.Client) (*http.Response, error) {
+	vm := newRuntime(client)
+
+	var body []byte
+	if res.Body != nil {
+		body, _ = io.ReadAll(res.Body)
+		res.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	var done *jsDone
+	_ = vm.Set("$done", func(v goja.Value) { done = parseDone(vm, v) })
+	_ = vm.Set("$response", map[string]interface{}{
+		"status":  res.StatusCode,
+		"headers": flattenHeader(res.Header),
+		"body":    string(body),
+	})
+
+	if _, err := runScript(vm, source); err != nil {
+		return nil, err
+	}
+
+	if done == nil || done.Response == nil {
+		return nil, nil
+	}
+
+	return buildResponse(res.Request, done.Response), nil
+}
+
+// runFrameScript evaluates source against one WebSocket frame's UTF-8
+// payload, returning the replacement payload if the script returned a
+// string.
+func runFrameScript(source string, payload string, fromClient bool) (string, error) {
+	vm := newRuntime(nil)
+
+	_ = vm.Set("$frame", map[string]interface{}{
+		"payload":    payload,
+		"fromClient": fromClient,
+	})
+
+	v, err := runScript(vm, source)
+	if err != nil {
+		return "", err
+	}
+
+	if v == nil {
+		return payload, nil
+	}
+
+	if s, ok := v.Export().(string); ok {
+		return s, nil
+	}
+
+	return payload, nil
+}
+
+func parseDone(vm *goja.Runtime, v goja.Value) *jsDone {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return nil
+	}
+
+	obj := v.ToObject(vm)
+	done := &jsDone{}
+
+	if r := obj.Get("response"); r != nil && !goja.IsUndefined(r) {
+		ro := r.ToObject(vm)
+		resp := &jsResponse{Headers: map[string]string{}}
+		if s := ro.Get("status"); s != nil {
+			resp.Status = int(s.ToInteger())
+		}
+		if b := ro.Get("body"); b != nil {
+			resp.Body = b.String()
+		}
+		if h := ro.Get("headers"); h != nil && !goja.IsUndefined(h) {
+			ho := h.ToObject(vm)
+			for _, k := range ho.Keys() {
+				resp.Headers[k] = ho.Get(k).String()
+			}
+		}
+		done.Response = resp
+	}
+
+	if r := obj.Get("request"); r != nil && !goja.IsUndefined(r) {
+		ro := r.ToObject(vm)
+		req := &jsRequest{Headers: map[string]string{}}
+		if u := ro.Get("url"); u != nil {
+			req.URL = u.String()
+		}
+		if m := ro.Get("method"); m != nil && !goja.IsUndefined(m) {
+			req.Method = m.String()
+		}
+		if b := ro.Get("body"); b != nil {
+			req.Body = b.String()
+		}
+		if h := ro.Get("headers"); h != nil && !goja.IsUndefined(h) {
+			ho := h.ToObject(vm)
+			for _, k := range ho.Keys() {
+				req.Headers[k] = ho.Get(k).String()
+			}
+		}
+		done.Request = req
+	}
+
+	return done
+}
+
+func buildResponse(req *http.Request, r *jsResponse) *http.Response {
+	res := &http.Response{
+		StatusCode: r.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(r.Body)),
+		Request:    req,
+	}
+
+	for k, v := range r.Headers {
+		res.Header.Set(k, v)
+	}
+	res.ContentLength = int64(len(r.Body))
+
+	return res
+}
+
+func applyRequest(req *http.Request, r *jsRequest) *http.Request {
+	if r.URL != "" {
+		if u, err := req.URL.Parse(r.URL); err == nil {
+			req.URL = u
+		}
+	}
+	if r.Method != "" {
+		req.Method = r.Method
+	}
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+	if r.Body != "" {
+		req.Body = io.NopCloser(strings.NewReader(r.Body))
+		req.ContentLength = int64(len(r.Body))
+	}
+
+	return req
+}
@@ -0,0 +1,139 @@
+package mitm
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+
+	"github.com/andybalholm/brotli"
+)
+
+// StreamHandler is an optional extension of MITMHandler for callers that want
+// to inspect or rewrite request/response bodies as they flow through,
+// instead of waiting for the whole body to be buffered. When implemented,
+// HandleConn hands it the body as an io.Reader and sends on whatever reader
+// it returns, rather than materializing the body, which keeps large downloads
+// and long-lived SSE responses from being read into memory.
+type StreamHandler interface {
+	HandleRequestStream(session *Session, body io.Reader) io.Reader
+	HandleResponseStream(session *Session, body io.Reader) io.Reader
+}
+
+// PassThroughHandler lets a handler opt a session out of buffering/transform
+// helpers (the forced Accept-Encoding rewrite, decode-then-reencode) so the
+// bytes reach the wire untouched.
+type PassThroughHandler interface {
+	ShouldPassThrough(session *Session) bool
+}
+
+func shouldPassThrough(session *Session, opt *Option) bool {
+	pt, ok := opt.Handler.(PassThroughHandler)
+	return ok && pt.ShouldPassThrough(session)
+}
+
+// applyRequestStream rewrites session.request.Body into the handler's
+// streaming pipeline, if one is configured.
+func applyRequestStream(session *Session, opt *Option) {
+	handler, ok := opt.Handler.(StreamHandler)
+	if !ok || session.request.Body == nil {
+		return
+	}
+
+	out := handler.HandleRequestStream(session, session.request.Body)
+	session.request.Body = io.NopCloser(out)
+	session.request.ContentLength = -1
+}
+
+// applyResponseStream decodes the response body according to its
+// Content-Encoding (so the handler always sees plaintext), runs it through
+// the handler's streaming pipeline, then re-encodes it with the same
+// Content-Encoding before it goes back on the wire. Transfer-Encoding:
+// chunked is preserved by leaving ContentLength unknown.
+func applyResponseStream(session *Session, opt *Option) error {
+	handler, ok := opt.Handler.(StreamHandler)
+	if !ok || session.response.Body == nil {
+		return nil
+	}
+
+	encoding := session.response.Header.Get("Content-Encoding")
+
+	decoded, err := decodeBody(encoding, session.response.Body)
+	if err != nil {
+		return err
+	}
+
+	piped := handler.HandleResponseStream(session, decoded)
+
+	encoded, err := encodeBody(encoding, piped)
+	if err != nil {
+		return err
+	}
+
+	session.response.Body = encoded
+	session.response.ContentLength = -1
+	session.response.Header.Del("Content-Length")
+
+	return nil
+}
+
+func decodeBody(encoding string, body io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return flate.NewReader(body), nil
+	case "br":
+		return brotli.NewReader(body), nil
+	default:
+		return body, nil
+	}
+}
+
+// encodeBody re-compresses r with encoding by streaming it through an
+// io.Pipe. The returned ReadCloser's Close unblocks the pipe (io.PipeReader
+// already forwards Close to CloseWithError), so an aborted response body —
+// e.g. the client disconnecting mid-download — doesn't leave the writer
+// goroutine below blocked in pw.Write forever, pinning the upstream
+// connection it's copying from.
+func encodeBody(encoding string, r io.Reader) (io.ReadCloser, error) {
+	if encoding == "" {
+		return io.NopCloser(r), nil
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		var (
+			w   io.WriteCloser
+			err error
+		)
+
+		switch encoding {
+		case "gzip":
+			w = gzip.NewWriter(pw)
+		case "deflate":
+			w, err = flate.NewWriter(pw, flate.DefaultCompression)
+		case "br":
+			w = brotli.NewWriter(pw)
+		default:
+			w = nopWriteCloser{pw}
+		}
+
+		if err != nil {
+			_ = pw.CloseWithError(err)
+			return
+		}
+
+		_, err = io.Copy(w, r)
+		_ = w.Close()
+		_ = pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
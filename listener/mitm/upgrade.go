@@ -0,0 +1,288 @@
+package mitm
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	C "github.com/Dreamacro/clash/constant"
+)
+
+// WebSocketFrameHandler is an optional extension of MITMHandler. Implementations
+// that also satisfy this interface get a chance to inspect or rewrite every
+// WebSocket frame tunneled through a hijacked connection. frame is the
+// decoded (unmasked) payload of that one frame, not the raw wire bytes (a
+// fragmented message arrives as one call per fragment); whatever is
+// returned is re-framed (with a freshly recomputed length and, for
+// client-to-server frames, a fresh mask) before being relayed.
+type WebSocketFrameHandler interface {
+	HandleWebSocketFrame(session *Session, frame []byte, fromClient bool) []byte
+}
+
+// isUpgradeRequest reports whether request is asking to switch protocols
+// (currently only WebSocket is recognised, same as listener/http).
+func isUpgradeRequest(request *http.Request) bool {
+	return strings.EqualFold(request.Header.Get("Upgrade"), "websocket") &&
+		headerContainsToken(request.Header.Get("Connection"), "upgrade")
+}
+
+func headerContainsToken(header, token string) bool {
+	for _, value := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(value), token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handleUpgrade dials the origin server through the same proxy-chain
+// dialer the rest of HandleConn uses, replays the upgrade handshake, and
+// if the origin switches protocols, tunnels the resulting WebSocket frames
+// bidirectionally, handing each one to opt.Handler when it implements
+// WebSocketFrameHandler. It returns true once the connection has been fully
+// handled (successfully or not) and the caller should stop processing it as
+// plain HTTP.
+func handleUpgrade(session *Session, opt *Option, source net.Addr, in chan<- C.ConnContext) (bool, error) {
+	if !isUpgradeRequest(session.request) {
+		return false, nil
+	}
+
+	upstream, err := dialUpstream(session.request, source, in)
+	if err != nil {
+		return true, err
+	}
+	defer func() { _ = upstream.Close() }()
+
+	if err = session.request.Write(upstream); err != nil {
+		return true, err
+	}
+
+	response, err := http.ReadResponse(bufio.NewReader(upstream), session.request)
+	if err != nil {
+		return true, err
+	}
+	session.response = response
+
+	if err = session.response.Write(session.conn); err != nil {
+		return true, err
+	}
+
+	if session.response.StatusCode != http.StatusSwitchingProtocols {
+		return true, nil
+	}
+
+	relayWebSocket(session, opt, upstream)
+
+	return true, nil
+}
+
+// dialUpstream dials request's origin the same way the rest of HandleConn
+// does: through newClient's transport, so the connection is routed via the
+// in channel and subject to Clash's rule-based proxy selection. It honours
+// request.URL.Scheme/TLS to pick the right default port and, for wss
+// origins, to complete a TLS handshake before the upgrade handshake is
+// replayed on top.
+func dialUpstream(request *http.Request, source net.Addr, in chan<- C.ConnContext) (net.Conn, error) {
+	secure := request.URL.Scheme == "https" || request.TLS != nil
+
+	host := request.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		port := "80"
+		if secure {
+			port = "443"
+		}
+		host = net.JoinHostPort(host, port)
+	}
+
+	client := newClient(source, request.Header.Get("User-Agent"), in)
+	defer client.CloseIdleConnections()
+
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport.DialContext == nil {
+		return net.Dial("tcp", host)
+	}
+
+	conn, err := transport.DialContext(request.Context(), "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	if !secure {
+		return conn, nil
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: hostOnly(host)})
+	if err := tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+
+	return host
+}
+
+func relayWebSocket(session *Session, opt *Option, upstream net.Conn) {
+	errCh := make(chan error, 2)
+
+	go func() { errCh <- copyWebSocketFrames(upstream, session.conn, session, opt, true) }()
+	go func() { errCh <- copyWebSocketFrames(session.conn, upstream, session, opt, false) }()
+
+	<-errCh
+}
+
+// wsFrame is one RFC 6455 frame, decoded down to its FIN bit, opcode, and
+// plaintext (unmasked) payload.
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// copyWebSocketFrames reads complete WebSocket frames from src, offers each
+// one's decoded payload to the handler, and re-frames the (possibly
+// rewritten) payload before writing it to dst. fromClient indicates the
+// direction of the frame relative to the intercepted client, which per
+// RFC 6455 also determines whether the outgoing frame must be masked
+// (client-to-server) or must not be (server-to-client).
+func copyWebSocketFrames(dst io.Writer, src io.Reader, session *Session, opt *Option, fromClient bool) error {
+	handler, _ := opt.Handler.(WebSocketFrameHandler)
+
+	r := bufio.NewReader(src)
+	for {
+		frame, err := readWebSocketFrame(r)
+		if err != nil {
+			return err
+		}
+
+		if handler != nil {
+			if out := handler.HandleWebSocketFrame(session, frame.payload, fromClient); out != nil {
+				frame.payload = out
+			}
+		}
+
+		if err = writeWebSocketFrame(dst, frame, fromClient); err != nil {
+			return err
+		}
+	}
+}
+
+// readWebSocketFrame reads one RFC 6455 frame from r and returns its FIN
+// bit, opcode, and payload with masking already undone.
+func readWebSocketFrame(r io.Reader) (wsFrame, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return wsFrame{}, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	payloadLen := uint64(header[1] & 0x7f)
+
+	switch payloadLen {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return wsFrame{}, err
+		}
+		payloadLen = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return wsFrame{}, err
+		}
+		payloadLen = binary.BigEndian.Uint64(ext)
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return wsFrame{}, err
+		}
+	}
+
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return wsFrame{}, err
+	}
+
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+
+	return wsFrame{fin: fin, opcode: opcode, payload: payload}, nil
+}
+
+// writeWebSocketFrame encodes frame back to the wire, recomputing its length
+// fields from the (possibly rewritten) payload and, when masked is true,
+// applying a freshly generated mask as RFC 6455 requires for every
+// client-to-server frame.
+func writeWebSocketFrame(w io.Writer, frame wsFrame, masked bool) error {
+	var out []byte
+
+	b0 := frame.opcode & 0x0f
+	if frame.fin {
+		b0 |= 0x80
+	}
+	out = append(out, b0)
+
+	payloadLen := len(frame.payload)
+
+	var b1 byte
+	if masked {
+		b1 |= 0x80
+	}
+
+	switch {
+	case payloadLen <= 125:
+		out = append(out, b1|byte(payloadLen))
+	case payloadLen <= 0xffff:
+		ext := make([]byte, 2)
+		binary.BigEndian.PutUint16(ext, uint16(payloadLen))
+		out = append(out, b1|126)
+		out = append(out, ext...)
+	default:
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(payloadLen))
+		out = append(out, b1|127)
+		out = append(out, ext...)
+	}
+
+	payload := frame.payload
+	if masked {
+		mask := make([]byte, 4)
+		if _, err := rand.Read(mask); err != nil {
+			return err
+		}
+
+		maskedPayload := make([]byte, payloadLen)
+		for i, b := range payload {
+			maskedPayload[i] = b ^ mask[i%4]
+		}
+
+		out = append(out, mask...)
+		payload = maskedPayload
+	}
+
+	out = append(out, payload...)
+
+	_, err := w.Write(out)
+	return err
+}